@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aaronriekenberg/go-doh-proxy/proxy"
+)
+
+func awaitShutdownSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	log.Fatalf("Signal (%v) received, stopping", s)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+
+	if len(os.Args) != 2 {
+		log.Fatalf("Usage: %v <config json file>", os.Args[0])
+	}
+
+	configFile := os.Args[1]
+	configuration, err := proxy.ReadConfiguration(configFile)
+	if err != nil {
+		log.Fatalf("proxy.ReadConfiguration error: %v", err)
+	}
+
+	dnsProxy := proxy.NewDNSProxy(configuration)
+	dnsProxy.Start()
+
+	awaitShutdownSignal()
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+func getCacheKey(r *dns.Msg) string {
+	if len(r.Question) == 0 {
+		return ""
+	}
+
+	question := &r.Question[0]
+	return fmt.Sprintf("%s:%d", dns.CanonicalName(question.Name), question.Qtype)
+}
+
+type cacheObject struct {
+	cacheTime       time.Time
+	expirationTime  time.Time
+	message         dns.Msg
+	hitCount        uint64
+	refreshInFlight int32
+}
+
+func (cacheObject *cacheObject) expired(now time.Time) bool {
+	return now.After(cacheObject.expirationTime)
+}
+
+func (cacheObject *cacheObject) durationInCache(now time.Time) time.Duration {
+	return now.Sub(cacheObject.cacheTime)
+}
+
+func (cacheObject *cacheObject) incrementHitCount() uint64 {
+	return atomic.AddUint64(&cacheObject.hitCount, 1)
+}
+
+func (cacheObject *cacheObject) loadHitCount() uint64 {
+	return atomic.LoadUint64(&cacheObject.hitCount)
+}
+
+// ttlFractionRemaining returns the fraction of this entry's TTL window still
+// remaining at now (1.0 when just cached, 0.0 at expiry, negative after
+// expiry), used to identify entries nearing expiry.
+func (cacheObject *cacheObject) ttlFractionRemaining(now time.Time) float64 {
+	totalTTL := cacheObject.expirationTime.Sub(cacheObject.cacheTime)
+	if totalTTL <= 0 {
+		return 0
+	}
+
+	remaining := cacheObject.expirationTime.Sub(now)
+	return float64(remaining) / float64(totalTTL)
+}
+
+// tryBeginRefresh atomically claims this entry for a prefetch refresh,
+// returning false if a refresh is already in flight.
+func (cacheObject *cacheObject) tryBeginRefresh() bool {
+	return atomic.CompareAndSwapInt32(&cacheObject.refreshInFlight, 0, 1)
+}
+
+func (cacheObject *cacheObject) endRefresh() {
+	atomic.StoreInt32(&cacheObject.refreshInFlight, 0)
+}
+
+type cache struct {
+	lruCache *lru.Cache
+}
+
+func newCache(maxSize int) cache {
+	lruCache, err := lru.New(maxSize)
+	if err != nil {
+		log.Fatalf("lru.New error: %v", err)
+	}
+
+	return cache{
+		lruCache: lruCache,
+	}
+}
+
+func (cache *cache) get(key string) (*cacheObject, bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+
+	value, ok := cache.lruCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	cacheObject := value.(*cacheObject)
+	cacheObject.incrementHitCount()
+
+	return cacheObject, true
+}
+
+// peek returns the cacheObject for key without affecting its LRU recency or
+// hit count, for use by background scans such as prefetching.
+func (cache *cache) peek(key string) (*cacheObject, bool) {
+	value, ok := cache.lruCache.Peek(key)
+	if !ok {
+		return nil, false
+	}
+
+	return value.(*cacheObject), true
+}
+
+func (cache *cache) add(key string, value *cacheObject) {
+	if len(key) == 0 {
+		return
+	}
+
+	cache.lruCache.Add(key, value)
+}
+
+func (cache *cache) len() int {
+	return cache.lruCache.Len()
+}
+
+func (cache *cache) keys() []string {
+	rawKeys := cache.lruCache.Keys()
+
+	keys := make([]string, 0, len(rawKeys))
+	for _, rawKey := range rawKeys {
+		keys = append(keys, rawKey.(string))
+	}
+
+	return keys
+}
+
+func (cache *cache) periodicPurge(maxPurgeItems int) (itemsPurged int) {
+	for itemsPurged < maxPurgeItems {
+		key, value, ok := cache.lruCache.GetOldest()
+		if !ok {
+			break
+		}
+
+		cacheObject := value.(*cacheObject)
+
+		if cacheObject.expired(time.Now()) {
+			cache.lruCache.Remove(key)
+			itemsPurged++
+		} else {
+			break
+		}
+	}
+
+	return
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CloakEntryConfiguration configures a single cloaked name.
+type CloakEntryConfiguration struct {
+	Name       string   `json:"name"`
+	Addresses  []string `json:"addresses"`
+	CNAME      string   `json:"cname"`
+	TTLSeconds uint32   `json:"ttlSeconds"`
+}
+
+// CloakPluginConfiguration configures the cloak plugin.
+type CloakPluginConfiguration struct {
+	Enabled bool                      `json:"enabled"`
+	Entries []CloakEntryConfiguration `json:"entries"`
+}
+
+// cloakPlugin synthesizes A/AAAA/CNAME answers for configured names instead
+// of forwarding the query to the upstream resolver.
+type cloakPlugin struct {
+	metrics        *metrics
+	namesToEntries map[string]CloakEntryConfiguration
+}
+
+func newCloakPlugin(configuration CloakPluginConfiguration, metrics *metrics) *cloakPlugin {
+	namesToEntries := make(map[string]CloakEntryConfiguration)
+	for _, entry := range configuration.Entries {
+		namesToEntries[strings.ToLower(dns.Fqdn(entry.Name))] = entry
+	}
+
+	return &cloakPlugin{
+		metrics:        metrics,
+		namesToEntries: namesToEntries,
+	}
+}
+
+func (plugin *cloakPlugin) name() string {
+	return "cloak"
+}
+
+func (plugin *cloakPlugin) onQuery(ctx context.Context, request *dns.Msg) (pluginAction, *dns.Msg, int) {
+	if len(request.Question) == 0 {
+		return actionContinue, nil, 0
+	}
+
+	question := &request.Question[0]
+
+	entry, ok := plugin.namesToEntries[strings.ToLower(question.Name)]
+	if !ok {
+		return actionContinue, nil, 0
+	}
+
+	makeHeader := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+			Ttl:    entry.TTLSeconds,
+		}
+	}
+
+	var answer []dns.RR
+
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, address := range entry.Addresses {
+			ip := net.ParseIP(address)
+			if (ip == nil) || (ip.To4() == nil) {
+				continue
+			}
+			answer = append(answer, &dns.A{Hdr: makeHeader(dns.TypeA), A: ip})
+		}
+
+	case dns.TypeAAAA:
+		for _, address := range entry.Addresses {
+			ip := net.ParseIP(address)
+			if (ip == nil) || (ip.To4() != nil) {
+				continue
+			}
+			answer = append(answer, &dns.AAAA{Hdr: makeHeader(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+
+	if (len(answer) == 0) && (len(entry.CNAME) == 0) {
+		return actionContinue, nil, 0
+	}
+
+	if len(entry.CNAME) > 0 {
+		cnameRR := &dns.CNAME{Hdr: makeHeader(dns.TypeCNAME), Target: dns.Fqdn(entry.CNAME)}
+		answer = append([]dns.RR{cnameRR}, answer...)
+	}
+
+	responseMsg := new(dns.Msg)
+	responseMsg.SetReply(request)
+	responseMsg.Authoritative = true
+	responseMsg.Answer = answer
+
+	plugin.metrics.incrementPluginSynthesized(plugin.name())
+
+	return actionSynthesize, responseMsg, 0
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+// HostAndPort is a host and port pair.
+type HostAndPort struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+func (hostAndPort *HostAndPort) joinHostPort() string {
+	return net.JoinHostPort(hostAndPort.Host, hostAndPort.Port)
+}
+
+// ForwardNameToAddress is a forward name to IP address mapping.
+type ForwardNameToAddress struct {
+	Name      string `json:"name"`
+	IPAddress string `json:"ipAddress"`
+}
+
+// ReverseAddressToName is a reverse address to name mapping.
+type ReverseAddressToName struct {
+	ReverseAddress string `json:"reverseAddress"`
+	Name           string `json:"name"`
+}
+
+// DoHServerConfiguration is the configuration for the inbound DNS-over-HTTPS listener.
+type DoHServerConfiguration struct {
+	Enabled       bool        `json:"enabled"`
+	ListenAddress HostAndPort `json:"listenAddress"`
+	CertFile      string      `json:"certFile"`
+	KeyFile       string      `json:"keyFile"`
+}
+
+// PluginsConfiguration configures the optional query/response plugin pipeline.
+type PluginsConfiguration struct {
+	NameBlock NameBlockPluginConfiguration `json:"nameBlock"`
+	IPBlock   IPBlockPluginConfiguration   `json:"ipBlock"`
+	Cloak     CloakPluginConfiguration     `json:"cloak"`
+}
+
+// Configuration is the DNS proxy configuration.
+type Configuration struct {
+	ListenAddress                HostAndPort                  `json:"listenAddress"`
+	DoHServerConfiguration       DoHServerConfiguration       `json:"dohServerConfiguration"`
+	PluginsConfiguration         PluginsConfiguration         `json:"pluginsConfiguration"`
+	DNS64Configuration           DNS64Configuration           `json:"dns64Configuration"`
+	UpstreamManagerConfiguration UpstreamManagerConfiguration `json:"upstreamManagerConfiguration"`
+	QueryLogConfiguration        QueryLogConfiguration        `json:"queryLogConfiguration"`
+	PrefetchConfiguration        PrefetchConfiguration        `json:"prefetchConfiguration"`
+	EDNSConfiguration            EDNSConfiguration            `json:"ednsConfiguration"`
+	RemoteHTTPURLs               []string                     `json:"remoteHTTPURLs"`
+	ForwardNamesToAddresses      []ForwardNameToAddress       `json:"forwardNamesToAddresses"`
+	ForwardDomain                string                       `json:"forwardDomain"`
+	ForwardResponseTTLSeconds    uint32                       `json:"forwardResponseTTLSeconds"`
+	ReverseAddressesToNames      []ReverseAddressToName       `json:"reverseAddressesToNames"`
+	ReverseDomain                string                       `json:"reverseDomain"`
+	ReverseResponseTTLSeconds    uint32                       `json:"reverseResponseTTLSeconds"`
+	ProxyMinTTLSeconds           uint32                       `json:"proxyMinTTLSeconds"`
+	ProxyMaxTTLSeconds           uint32                       `json:"proxyMaxTTLSeconds"`
+	MaxCacheSize                 int                          `json:"maxCacheSize"`
+	TimerIntervalSeconds         uint32                       `json:"timerIntervalSeconds"`
+	MaxCachePurgesPerTimerPop    int                          `json:"maxCachePurgesPerTimerPop"`
+}
+
+// ReadConfiguration reads the DNS proxy configuration from a json file.
+func ReadConfiguration(configFile string) (*Configuration, error) {
+	log.Printf("reading config file %q", configFile)
+
+	source, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile error: %w", err)
+	}
+
+	var configuration Configuration
+	if err := json.Unmarshal(source, &configuration); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal error: %w", err)
+	}
+
+	return &configuration, nil
+}
@@ -22,6 +22,12 @@ type dnsProxy struct {
 	dohClient               dohClient
 	cache                   cache
 	metrics                 metrics
+	queryPlugins            []queryPlugin
+	responsePlugins         []responsePlugin
+	dns64                   *dns64
+	queryLog                *queryLog
+	prefetcher              *prefetcher
+	edns                    *ednsProcessor
 }
 
 // NewDNSProxy creates a DNS proxy.
@@ -37,13 +43,64 @@ func NewDNSProxy(configuration *Configuration) DNSProxy {
 		reverseAddressesToNames[strings.ToLower(reverseAddressToName.ReverseAddress)] = reverseAddressToName.Name
 	}
 
-	return &dnsProxy{
+	dnsProxy := &dnsProxy{
 		configuration:           configuration,
 		forwardNamesToAddresses: forwardNamesToAddresses,
 		reverseAddressesToNames: reverseAddressesToNames,
-		dohClient:               newDOHClient(configuration.RemoteHTTPURLs),
 		cache:                   newCache(configuration.MaxCacheSize),
 	}
+
+	dnsProxy.dohClient = newDOHClient(configuration.RemoteHTTPURLs, configuration.UpstreamManagerConfiguration, &dnsProxy.metrics)
+
+	pluginsConfiguration := configuration.PluginsConfiguration
+
+	if pluginsConfiguration.NameBlock.Enabled {
+		dnsProxy.queryPlugins = append(dnsProxy.queryPlugins, newNameBlockPlugin(pluginsConfiguration.NameBlock, &dnsProxy.metrics))
+	}
+
+	if pluginsConfiguration.Cloak.Enabled {
+		dnsProxy.queryPlugins = append(dnsProxy.queryPlugins, newCloakPlugin(pluginsConfiguration.Cloak, &dnsProxy.metrics))
+	}
+
+	if pluginsConfiguration.IPBlock.Enabled {
+		dnsProxy.responsePlugins = append(dnsProxy.responsePlugins, newIPBlockPlugin(pluginsConfiguration.IPBlock, &dnsProxy.metrics))
+	}
+
+	if configuration.DNS64Configuration.Enabled {
+		dnsProxy.dns64 = newDNS64(configuration.DNS64Configuration, &dnsProxy.dohClient, &dnsProxy.cache, &dnsProxy.metrics)
+	}
+
+	if configuration.QueryLogConfiguration.Enabled {
+		dnsProxy.queryLog = newQueryLog(configuration.QueryLogConfiguration)
+	}
+
+	if configuration.PrefetchConfiguration.Enabled {
+		dnsProxy.prefetcher = newPrefetcher(configuration.PrefetchConfiguration, dnsProxy)
+	}
+
+	if configuration.EDNSConfiguration.Enabled {
+		dnsProxy.edns = newEDNSProcessor(configuration.EDNSConfiguration)
+	}
+
+	return dnsProxy
+}
+
+func (dnsProxy *dnsProxy) runQueryPlugins(ctx context.Context, request *dns.Msg) (pluginAction, *dns.Msg, int) {
+	for _, plugin := range dnsProxy.queryPlugins {
+		if action, response, rcode := plugin.onQuery(ctx, request); action != actionContinue {
+			return action, response, rcode
+		}
+	}
+
+	return actionContinue, nil, 0
+}
+
+func (dnsProxy *dnsProxy) runResponsePlugins(ctx context.Context, request, response *dns.Msg) *dns.Msg {
+	for _, plugin := range dnsProxy.responsePlugins {
+		response = plugin.onResponse(ctx, request, response)
+	}
+
+	return response
 }
 
 func (dnsProxy *dnsProxy) clampAndGetMinTTLSeconds(m *dns.Msg) uint32 {
@@ -81,6 +138,36 @@ func (dnsProxy *dnsProxy) clampAndGetMinTTLSeconds(m *dns.Msg) uint32 {
 	return minTTLSeconds
 }
 
+// minResponseTTLSeconds returns the smallest TTL among m's answer/authority/
+// additional records without modifying them, for reporting purposes (e.g. a
+// DoH Cache-Control header) on an already-finalized response.
+func minResponseTTLSeconds(m *dns.Msg) uint32 {
+	foundRRHeaderTTL := false
+	var minTTLSeconds uint32
+
+	observeRRHeader := func(rrHeader *dns.RR_Header) {
+		if (!foundRRHeaderTTL) || (rrHeader.Ttl < minTTLSeconds) {
+			minTTLSeconds = rrHeader.Ttl
+			foundRRHeaderTTL = true
+		}
+	}
+
+	for _, rr := range m.Answer {
+		observeRRHeader(rr.Header())
+	}
+	for _, rr := range m.Ns {
+		observeRRHeader(rr.Header())
+	}
+	for _, rr := range m.Extra {
+		rrHeader := rr.Header()
+		if rrHeader.Rrtype != dns.TypeOPT {
+			observeRRHeader(rrHeader)
+		}
+	}
+
+	return minTTLSeconds
+}
+
 func (dnsProxy *dnsProxy) getCachedMessageCopyForHit(cacheKey string) *dns.Msg {
 
 	uncopiedCacheObject, ok := dnsProxy.cache.get(cacheKey)
@@ -165,6 +252,22 @@ func (dnsProxy *dnsProxy) writeResponse(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
+// finalizeAndWriteResponse applies EDNS UDP payload size negotiation
+// (truncating over UDP and setting TC=1 when required), logs any upstream
+// extended DNS error, and writes response to w.
+func (dnsProxy *dnsProxy) finalizeAndWriteResponse(w dns.ResponseWriter, request, response *dns.Msg) {
+	if dnsProxy.edns != nil {
+		logUpstreamEDE(response)
+
+		if w.RemoteAddr().Network() == "udp" {
+			udpSize := dnsProxy.edns.negotiateUDPSize(request)
+			truncateForUDP(response, udpSize)
+		}
+	}
+
+	dnsProxy.writeResponse(w, response)
+}
+
 func (dnsProxy *dnsProxy) createProxyHandlerFunc() dns.HandlerFunc {
 
 	return func(w dns.ResponseWriter, r *dns.Msg) {
@@ -174,44 +277,145 @@ func (dnsProxy *dnsProxy) createProxyHandlerFunc() dns.HandlerFunc {
 
 		requestID := r.Id
 		cacheKey := getCacheKey(r)
+		startTime := time.Now()
+
+		var qname, qtype, qclass string
+		if len(r.Question) == 1 {
+			qname = r.Question[0].Name
+			qtype = dns.Type(r.Question[0].Qtype).String()
+			qclass = dns.Class(r.Question[0].Qclass).String()
+		}
+
+		logQuery := func(response *dns.Msg, cacheStatus, upstream, pluginAction string) {
+			dnsProxy.logQuery(queryLogRecord{
+				ClientAddress: w.RemoteAddr().String(),
+				QName:         qname,
+				QType:         qtype,
+				QClass:        qclass,
+				Rcode:         rcodeString(response),
+				AnswerCount:   answerCount(response),
+				CacheStatus:   cacheStatus,
+				Upstream:      upstream,
+				LatencyMs:     time.Since(startTime).Milliseconds(),
+				PluginAction:  pluginAction,
+			})
+		}
+
+		if action, pluginResponse, rejectRcode := dnsProxy.runQueryPlugins(ctx, r); action != actionContinue {
+			switch action {
+			case actionDrop:
+				logQuery(nil, "", "", "drop")
+				return
+
+			case actionReject:
+				rejectResponse := new(dns.Msg)
+				rejectResponse.SetRcode(r, rejectRcode)
+				dnsProxy.finalizeAndWriteResponse(w, r, rejectResponse)
+				logQuery(rejectResponse, "", "", "reject")
+				return
+
+			case actionSynthesize:
+				pluginResponse.Id = requestID
+				dnsProxy.finalizeAndWriteResponse(w, r, pluginResponse)
+				logQuery(pluginResponse, "", "", "synthesize")
+				return
+			}
+		}
+
+		if dnsProxy.dns64 != nil && len(r.Question) == 1 && r.Question[0].Qtype == dns.TypePTR {
+			if translated := dnsProxy.dns64.maybeTranslatePTR(ctx, r); translated != nil {
+				translated.Id = requestID
+				dnsProxy.finalizeAndWriteResponse(w, r, translated)
+				logQuery(translated, "", "", "dns64-ptr")
+				return
+			}
+		}
 
 		if cacheMessageCopy := dnsProxy.getCachedMessageCopyForHit(cacheKey); cacheMessageCopy != nil {
 			dnsProxy.metrics.incrementCacheHits()
+
+			if dnsProxy.dns64 != nil && len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAAAA {
+				if synthesized := dnsProxy.dns64.maybeSynthesizeAAAA(ctx, w.RemoteAddr(), r, cacheMessageCopy); synthesized != nil {
+					synthesized.Id = requestID
+					dnsProxy.finalizeAndWriteResponse(w, r, synthesized)
+					logQuery(synthesized, "hit", "", "dns64-aaaa")
+					return
+				}
+			}
+
 			cacheMessageCopy.Id = requestID
-			dnsProxy.writeResponse(w, cacheMessageCopy)
+			dnsProxy.finalizeAndWriteResponse(w, r, cacheMessageCopy)
+			logQuery(cacheMessageCopy, "hit", "", "")
 			return
 		}
 
+		var ecsSubnet string
+		if dnsProxy.edns != nil {
+			ecsSubnet = dnsProxy.edns.ecsSubnetForQuery(r, w.RemoteAddr())
+		}
+
 		dnsProxy.metrics.incrementCacheMisses()
 		r.Id = 0
-		responseMsg, err := dnsProxy.dohClient.makeHTTPRequest(ctx, r)
+		responseMsg, upstreamUsed, err := dnsProxy.dohClient.makeHTTPRequest(ctx, r, ecsSubnet)
 		if err != nil {
 			dnsProxy.metrics.incrementClientErrors()
 			log.Printf("makeHttpRequest error %v", err)
 			r.Id = requestID
 			dns.HandleFailed(w, r)
+			logQuery(nil, "miss", upstreamUsed, "error")
 			return
 		}
 
-		dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg)
+		responseMsg = dnsProxy.runResponsePlugins(ctx, r, responseMsg)
+
+		synthesizedByDNS64 := false
+		if dnsProxy.dns64 != nil && len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAAAA {
+			if synthesized := dnsProxy.dns64.maybeSynthesizeAAAA(ctx, w.RemoteAddr(), r, responseMsg); synthesized != nil {
+				responseMsg = synthesized
+				synthesizedByDNS64 = true
+			}
+		}
+
+		if !synthesizedByDNS64 {
+			dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg)
+		}
+
 		responseMsg.Id = requestID
-		dnsProxy.writeResponse(w, responseMsg)
+		dnsProxy.finalizeAndWriteResponse(w, r, responseMsg)
+		logQuery(responseMsg, "miss", upstreamUsed, "")
 	}
 }
 
 func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc() dns.HandlerFunc {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		startTime := time.Now()
+
 		if len(r.Question) == 0 {
 			dns.HandleFailed(w, r)
 			return
 		}
 
 		question := &(r.Question[0])
+
+		logQuery := func(response *dns.Msg) {
+			dnsProxy.logQuery(queryLogRecord{
+				ClientAddress: w.RemoteAddr().String(),
+				QName:         question.Name,
+				QType:         dns.Type(question.Qtype).String(),
+				QClass:        dns.Class(question.Qclass).String(),
+				Rcode:         rcodeString(response),
+				AnswerCount:   answerCount(response),
+				CacheStatus:   "authoritative",
+				LatencyMs:     time.Since(startTime).Milliseconds(),
+			})
+		}
+
 		responseMsg := new(dns.Msg)
 		if question.Qtype != dns.TypeA {
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			logQuery(responseMsg)
 			return
 		}
 
@@ -220,6 +424,7 @@ func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc() dns.HandlerFunc {
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			logQuery(responseMsg)
 			return
 		}
 
@@ -235,22 +440,40 @@ func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc() dns.HandlerFunc {
 			A: address,
 		})
 		dnsProxy.writeResponse(w, responseMsg)
+		logQuery(responseMsg)
 	}
 }
 
 func (dnsProxy *dnsProxy) createReverseHandlerFunc() dns.HandlerFunc {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		startTime := time.Now()
+
 		if len(r.Question) == 0 {
 			dns.HandleFailed(w, r)
 			return
 		}
 
 		question := &(r.Question[0])
+
+		logQuery := func(response *dns.Msg) {
+			dnsProxy.logQuery(queryLogRecord{
+				ClientAddress: w.RemoteAddr().String(),
+				QName:         question.Name,
+				QType:         dns.Type(question.Qtype).String(),
+				QClass:        dns.Class(question.Qclass).String(),
+				Rcode:         rcodeString(response),
+				AnswerCount:   answerCount(response),
+				CacheStatus:   "authoritative",
+				LatencyMs:     time.Since(startTime).Milliseconds(),
+			})
+		}
+
 		responseMsg := new(dns.Msg)
 		if question.Qtype != dns.TypePTR {
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			logQuery(responseMsg)
 			return
 		}
 
@@ -259,6 +482,7 @@ func (dnsProxy *dnsProxy) createReverseHandlerFunc() dns.HandlerFunc {
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			logQuery(responseMsg)
 			return
 		}
 
@@ -274,6 +498,7 @@ func (dnsProxy *dnsProxy) createReverseHandlerFunc() dns.HandlerFunc {
 			Ptr: name,
 		})
 		dnsProxy.writeResponse(w, responseMsg)
+		logQuery(responseMsg)
 	}
 
 }
@@ -326,6 +551,11 @@ func (dnsProxy *dnsProxy) Start() {
 
 	go dnsProxy.runServer(listenAddressAndPort, "tcp", serveMux)
 	go dnsProxy.runServer(listenAddressAndPort, "udp", serveMux)
+	go dnsProxy.runDOHServer(serveMux)
 
 	go dnsProxy.runPeriodicTimer()
+
+	if dnsProxy.prefetcher != nil {
+		go dnsProxy.prefetcher.run()
+	}
 }
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64Configuration configures DNS64 synthesis (RFC 6052) for IPv6-only clients.
+type DNS64Configuration struct {
+	Enabled            bool     `json:"enabled"`
+	Prefixes           []string `json:"prefixes"`
+	IgnoredSourceCIDRs []string `json:"ignoredSourceCIDRs"`
+	TranslatePTR       bool     `json:"translatePTR"`
+	MaxTTLSeconds      uint32   `json:"maxTTLSeconds"`
+}
+
+// dns64 synthesizes AAAA answers for IPv6-only clients by embedding an A
+// record's address into a NAT64 prefix (RFC 6052).
+type dns64 struct {
+	dohClient          *dohClient
+	cache              *cache
+	metrics            *metrics
+	prefixes           []net.IP
+	ignoredSourceCIDRs []*net.IPNet
+	translatePTR       bool
+	maxTTLSeconds      uint32
+}
+
+func newDNS64(configuration DNS64Configuration, dohClient *dohClient, cache *cache, metrics *metrics) *dns64 {
+	var prefixes []net.IP
+	for _, prefixString := range configuration.Prefixes {
+		ip, ipNet, err := net.ParseCIDR(prefixString)
+		if err != nil {
+			log.Fatalf("error parsing DNS64 prefix %q: %v", prefixString, err)
+		}
+		if ones, _ := ipNet.Mask.Size(); ones != 96 {
+			log.Fatalf("unsupported DNS64 prefix length for %q, only /96 NAT64 prefixes are supported", prefixString)
+		}
+		prefixes = append(prefixes, ip.To16())
+	}
+
+	var ignoredSourceCIDRs []*net.IPNet
+	for _, cidrString := range configuration.IgnoredSourceCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidrString)
+		if err != nil {
+			log.Fatalf("error parsing DNS64 ignoredSourceCIDR %q: %v", cidrString, err)
+		}
+		ignoredSourceCIDRs = append(ignoredSourceCIDRs, ipNet)
+	}
+
+	log.Printf("newDNS64 prefixes = %v ignoredSourceCIDRs = %v translatePTR = %v",
+		prefixes, ignoredSourceCIDRs, configuration.TranslatePTR)
+
+	return &dns64{
+		dohClient:          dohClient,
+		cache:              cache,
+		metrics:            metrics,
+		prefixes:           prefixes,
+		ignoredSourceCIDRs: ignoredSourceCIDRs,
+		translatePTR:       configuration.TranslatePTR,
+		maxTTLSeconds:      configuration.MaxTTLSeconds,
+	}
+}
+
+func (d *dns64) sourceIgnored(remoteAddr net.Addr) bool {
+	if remoteAddr == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range d.ignoredSourceCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *dns64) embedIPv4(ipv4 net.IP) net.IP {
+	prefix := d.prefixes[0]
+	ipv4 = ipv4.To4()
+
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, prefix)
+	copy(synthesized[12:], ipv4)
+
+	return synthesized
+}
+
+func aaaaSynthesisApplies(response *dns.Msg) bool {
+	if response.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	if response.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	for _, rr := range response.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return false
+		}
+	}
+
+	return true
+}
+
+func dns64CacheKey(name string) string {
+	return fmt.Sprintf("%s:%d:dns64", dns.CanonicalName(name), dns.TypeAAAA)
+}
+
+// maybeSynthesizeAAAA returns a synthesized AAAA response, or nil if
+// synthesis does not apply and the original response should be used.
+func (d *dns64) maybeSynthesizeAAAA(ctx context.Context, remoteAddr net.Addr, request, response *dns.Msg) *dns.Msg {
+	if len(d.prefixes) == 0 {
+		return nil
+	}
+
+	if d.sourceIgnored(remoteAddr) {
+		return nil
+	}
+
+	if !aaaaSynthesisApplies(response) {
+		return nil
+	}
+
+	question := &request.Question[0]
+	cacheKey := dns64CacheKey(question.Name)
+
+	if cached, ok := d.cache.get(cacheKey); ok && !cached.expired(time.Now()) {
+		messageCopy := cached.message.Copy()
+		messageCopy.SetReply(request)
+		return messageCopy
+	}
+
+	aRequest := new(dns.Msg)
+	aRequest.SetQuestion(question.Name, dns.TypeA)
+
+	aResponse, _, err := d.dohClient.makeHTTPRequest(ctx, aRequest, "")
+	if err != nil {
+		log.Printf("dns64 A lookup error: %v", err)
+		return nil
+	}
+
+	if aResponse.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	synthesizedResponse := new(dns.Msg)
+	synthesizedResponse.SetReply(request)
+	synthesizedResponse.Rcode = dns.RcodeSuccess
+
+	for _, rr := range aResponse.Answer {
+		aRecord, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+
+		ttl := aRecord.Header().Ttl
+		if ttl > d.maxTTLSeconds {
+			ttl = d.maxTTLSeconds
+		}
+
+		synthesizedResponse.Answer = append(synthesizedResponse.Answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			AAAA: d.embedIPv4(aRecord.A),
+		})
+	}
+
+	if len(synthesizedResponse.Answer) == 0 {
+		return nil
+	}
+
+	d.metrics.incrementDNS64Synthesized()
+
+	cacheObject := &cacheObject{
+		cacheTime:      time.Now(),
+		expirationTime: time.Now().Add(time.Duration(d.maxTTLSeconds) * time.Second),
+	}
+	synthesizedResponse.CopyTo(&cacheObject.message)
+	d.cache.add(cacheKey, cacheObject)
+
+	return synthesizedResponse
+}
+
+// ip6ARPAToIP parses a nibble-format ip6.arpa PTR qname back into the IPv6
+// address it represents.
+func ip6ARPAToIP(name string) net.IP {
+	name = strings.TrimSuffix(strings.ToLower(name), ".ip6.arpa.")
+	labels := strings.Split(name, ".")
+	if len(labels) != 32 {
+		return nil
+	}
+
+	var hex strings.Builder
+	for i := len(labels) - 1; i >= 0; i-- {
+		if len(labels[i]) != 1 {
+			return nil
+		}
+		hex.WriteString(labels[i])
+	}
+
+	hexString := hex.String()
+
+	var address strings.Builder
+	for i := 0; i < len(hexString); i += 4 {
+		if i > 0 {
+			address.WriteString(":")
+		}
+		address.WriteString(hexString[i : i+4])
+	}
+
+	return net.ParseIP(address.String())
+}
+
+// translatedPTRQuestionName returns the in-addr.arpa name to query upstream
+// in place of questionName, or "" if no translation applies.
+func (d *dns64) translatedPTRQuestionName(questionName string) string {
+	if !d.translatePTR {
+		return ""
+	}
+
+	if !strings.HasSuffix(strings.ToLower(questionName), "ip6.arpa.") {
+		return ""
+	}
+
+	ip := ip6ARPAToIP(questionName)
+	if ip == nil {
+		return ""
+	}
+
+	for _, prefix := range d.prefixes {
+		prefixNet := &net.IPNet{IP: prefix, Mask: net.CIDRMask(96, 128)}
+		if !prefixNet.Contains(ip) {
+			continue
+		}
+
+		ip16 := ip.To16()
+		embeddedIPv4 := net.IPv4(ip16[12], ip16[13], ip16[14], ip16[15])
+
+		reverseName, err := dns.ReverseAddr(embeddedIPv4.String())
+		if err != nil {
+			return ""
+		}
+
+		return reverseName
+	}
+
+	return ""
+}
+
+// maybeTranslatePTR answers a translatable ip6.arpa PTR query by querying
+// the equivalent in-addr.arpa name upstream.
+func (d *dns64) maybeTranslatePTR(ctx context.Context, request *dns.Msg) *dns.Msg {
+	if len(request.Question) != 1 {
+		return nil
+	}
+
+	question := &request.Question[0]
+	if question.Qtype != dns.TypePTR {
+		return nil
+	}
+
+	translatedName := d.translatedPTRQuestionName(question.Name)
+	if len(translatedName) == 0 {
+		return nil
+	}
+
+	translatedRequest := new(dns.Msg)
+	translatedRequest.SetQuestion(translatedName, dns.TypePTR)
+
+	translatedResponse, _, err := d.dohClient.makeHTTPRequest(ctx, translatedRequest, "")
+	if err != nil {
+		log.Printf("dns64 PTR translation lookup error: %v", err)
+		return nil
+	}
+
+	responseMsg := new(dns.Msg)
+	responseMsg.SetReply(request)
+	responseMsg.Rcode = translatedResponse.Rcode
+
+	for _, rr := range translatedResponse.Answer {
+		ptrRecord, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+
+		responseMsg.Answer = append(responseMsg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ptrRecord.Header().Ttl,
+			},
+			Ptr: ptrRecord.Ptr,
+		})
+	}
+
+	d.metrics.incrementDNS64Synthesized()
+
+	return responseMsg
+}
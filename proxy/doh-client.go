@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+const dnsJSONMIMEType = "application/dns-json"
+
+// dohClient resolves DNS queries via one or more upstream DoH JSON API
+// resolvers, selected according to the configured upstream strategy.
+type dohClient struct {
+	upstreamManager *upstreamManager
+}
+
+func newDOHClient(remoteHTTPURLs []string, upstreamManagerConfiguration UpstreamManagerConfiguration, metrics *metrics) dohClient {
+	return dohClient{
+		upstreamManager: newUpstreamManager(remoteHTTPURLs, upstreamManagerConfiguration, metrics),
+	}
+}
+
+// makeHTTPRequest resolves r against the configured upstreams, optionally
+// forwarding ecsSubnet as an EDNS client-subnet hint, and returns the
+// response along with the name of the upstream that answered it.
+func (dohClient *dohClient) makeHTTPRequest(ctx context.Context, r *dns.Msg, ecsSubnet string) (*dns.Msg, string, error) {
+	return dohClient.upstreamManager.makeHTTPRequest(ctx, r, ecsSubnet)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type dohJSONResponseAnswer struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type dohJSONResponse struct {
+	Status  int                     `json:"Status"`
+	Answer  []dohJSONResponseAnswer `json:"Answer"`
+	Comment string                  `json:"Comment"`
+}
+
+func decodeJSONResponse(request *dns.Msg, jsonResponse []byte) (*dns.Msg, error) {
+	var dohJSONResponse dohJSONResponse
+
+	if err := json.Unmarshal(jsonResponse, &dohJSONResponse); err != nil {
+		return nil, fmt.Errorf("error decoding json response: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(request)
+	resp.RecursionAvailable = true
+	resp.Rcode = dohJSONResponse.Status
+
+	for i := range dohJSONResponse.Answer {
+		answer := &dohJSONResponse.Answer[i]
+		rrType := uint16(answer.Type)
+
+		createRRHeader := func() dns.RR_Header {
+			return dns.RR_Header{
+				Name:   dns.Fqdn(answer.Name),
+				Rrtype: rrType,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(answer.TTL),
+			}
+		}
+
+		switch rrType {
+		case dns.TypeA:
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: createRRHeader(),
+				A:   net.ParseIP(answer.Data),
+			})
+
+		case dns.TypeAAAA:
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  createRRHeader(),
+				AAAA: net.ParseIP(answer.Data),
+			})
+
+		case dns.TypeCNAME:
+			resp.Answer = append(resp.Answer, &dns.CNAME{
+				Hdr:    createRRHeader(),
+				Target: dns.Fqdn(answer.Data),
+			})
+
+		case dns.TypePTR:
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: createRRHeader(),
+				Ptr: dns.Fqdn(answer.Data),
+			})
+
+		case dns.TypeTXT:
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: createRRHeader(),
+				// Trim leading and trailing \" from Data
+				Txt: []string{strings.Trim(answer.Data, "\"")},
+			})
+
+		default:
+			log.Printf("unknown json rrType = %v request = %v", rrType, request)
+		}
+	}
+
+	// The dns-json API has no dedicated EDE field; Cloudflare and Google both
+	// surface extended error text via "Comment" instead. Synthesize an EDE
+	// option (RFC 8914, info-code 0 "Other Error") carrying that text so
+	// logUpstreamEDE has a real signal to decode downstream.
+	if len(dohJSONResponse.Comment) > 0 {
+		resp.Extra = append(resp.Extra, &dns.OPT{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+			Option: []dns.EDNS0{&dns.EDNS0_LOCAL{
+				Code: ednsOptionCodeEDE,
+				Data: append([]byte{0, 0}, []byte(dohJSONResponse.Comment)...),
+			}},
+		})
+	}
+
+	return resp, nil
+}
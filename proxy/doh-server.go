@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+const dnsMessageMIMEType = "application/dns-message"
+
+// dohResponseWriter is a dns.ResponseWriter that captures the response
+// message in memory instead of writing it to a network connection, so a
+// DoH HTTP handler can run a query through the same dns.ServeMux pipeline
+// used by the UDP/TCP servers.
+type dohResponseWriter struct {
+	remoteAddr net.Addr
+	response   *dns.Msg
+}
+
+func newDOHResponseWriter(remoteAddr net.Addr) *dohResponseWriter {
+	return &dohResponseWriter{
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return nil
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.response = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("raw Write not supported for doh responses")
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (w *dohResponseWriter) Hijack() {
+}
+
+func parseDOHRequest(r *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		encoded := r.URL.Query().Get("dns")
+		if len(encoded) == 0 {
+			return nil, fmt.Errorf("missing dns query parameter")
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("base64.RawURLEncoding.DecodeString error: %w", err)
+		}
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageMIMEType {
+			return nil, fmt.Errorf("unsupported content type %q", r.Header.Get("Content-Type"))
+		}
+		buf, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadAll error: %w", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported method %q", r.Method)
+	}
+
+	requestMsg := new(dns.Msg)
+	if err := requestMsg.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("dns.Msg.Unpack error: %w", err)
+	}
+
+	return requestMsg, nil
+}
+
+func (dnsProxy *dnsProxy) createDOHHandlerFunc(serveMux *dns.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestMsg, err := parseDOHRequest(r)
+		if err != nil {
+			log.Printf("parseDOHRequest error: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
+		responseWriter := newDOHResponseWriter(&net.IPAddr{IP: net.ParseIP(remoteAddr)})
+
+		serveMux.ServeDNS(responseWriter, requestMsg)
+
+		responseMsg := responseWriter.response
+		if responseMsg == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+
+		packedResponse, err := responseMsg.Pack()
+		if err != nil {
+			log.Printf("dns.Msg.Pack error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		maxAgeSeconds := minResponseTTLSeconds(responseMsg)
+
+		w.Header().Set("Content-Type", dnsMessageMIMEType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAgeSeconds))
+		w.Write(packedResponse)
+	}
+}
+
+func (dnsProxy *dnsProxy) runDOHServer(serveMux *dns.ServeMux) {
+	dohServerConfiguration := dnsProxy.configuration.DoHServerConfiguration
+	if !dohServerConfiguration.Enabled {
+		return
+	}
+
+	listenAddressAndPort := dohServerConfiguration.ListenAddress.joinHostPort()
+
+	httpServeMux := http.NewServeMux()
+	httpServeMux.HandleFunc("/dns-query", dnsProxy.createDOHHandlerFunc(serveMux))
+
+	srv := &http.Server{
+		Addr:    listenAddressAndPort,
+		Handler: httpServeMux,
+	}
+
+	log.Printf("starting doh server on %v", listenAddressAndPort)
+
+	err := srv.ListenAndServeTLS(dohServerConfiguration.CertFile, dohServerConfiguration.KeyFile)
+	log.Fatalf("ListenAndServeTLS error: %v", err)
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// defaultMaxUDPSize is the default inbound/outbound EDNS UDP payload size
+// ceiling, matching the DNS Flag Day 2020 recommendation.
+const defaultMaxUDPSize = 1232
+
+// ECSClientPolicyConfiguration configures the EDNS client-subnet (ECS)
+// policy applied to clients within CIDR: "strip", "forward", or "synthesize".
+type ECSClientPolicyConfiguration struct {
+	CIDR           string `json:"cidr"`
+	Policy         string `json:"policy"`
+	V4PrefixLength uint8  `json:"v4PrefixLength"`
+	V6PrefixLength uint8  `json:"v6PrefixLength"`
+}
+
+// EDNSConfiguration configures EDNS(0) OPT record handling: client-subnet
+// scrubbing/forwarding on ingress and UDP payload size negotiation on egress.
+type EDNSConfiguration struct {
+	Enabled          bool                           `json:"enabled"`
+	MaxUDPSize       uint16                         `json:"maxUDPSize"`
+	DefaultECSPolicy string                         `json:"defaultECSPolicy"`
+	ClientPolicies   []ECSClientPolicyConfiguration `json:"clientPolicies"`
+}
+
+type ecsPolicyRule struct {
+	ipNet          *net.IPNet
+	policy         string
+	v4PrefixLength uint8
+	v6PrefixLength uint8
+}
+
+// ednsProcessor implements per-client ECS policy and EDNS UDP payload size
+// negotiation for the proxy handler.
+type ednsProcessor struct {
+	configuration EDNSConfiguration
+	rules         []ecsPolicyRule
+	maxUDPSize    uint16
+}
+
+func newEDNSProcessor(configuration EDNSConfiguration) *ednsProcessor {
+	var rules []ecsPolicyRule
+	for _, policyConfiguration := range configuration.ClientPolicies {
+		_, ipNet, err := net.ParseCIDR(policyConfiguration.CIDR)
+		if err != nil {
+			log.Fatalf("error parsing edns clientPolicies CIDR %q: %v", policyConfiguration.CIDR, err)
+		}
+
+		rules = append(rules, ecsPolicyRule{
+			ipNet:          ipNet,
+			policy:         policyConfiguration.Policy,
+			v4PrefixLength: policyConfiguration.V4PrefixLength,
+			v6PrefixLength: policyConfiguration.V6PrefixLength,
+		})
+	}
+
+	maxUDPSize := configuration.MaxUDPSize
+	if maxUDPSize == 0 {
+		maxUDPSize = defaultMaxUDPSize
+	}
+
+	return &ednsProcessor{
+		configuration: configuration,
+		rules:         rules,
+		maxUDPSize:    maxUDPSize,
+	}
+}
+
+func (processor *ednsProcessor) policyForClient(clientIP net.IP) (policy string, v4PrefixLength, v6PrefixLength uint8) {
+	for _, rule := range processor.rules {
+		if rule.ipNet.Contains(clientIP) {
+			return rule.policy, rule.v4PrefixLength, rule.v6PrefixLength
+		}
+	}
+
+	return processor.configuration.DefaultECSPolicy, 24, 56
+}
+
+func clientIPFromRemoteAddr(remoteAddr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+
+	return net.ParseIP(host)
+}
+
+func truncateIPToPrefix(ip net.IP, prefixLength uint8) net.IP {
+	mask := net.CIDRMask(int(prefixLength), len(ip)*8)
+	return ip.Mask(mask)
+}
+
+func ecsSubnetString(ip net.IP, v4PrefixLength, v6PrefixLength uint8) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		truncated := truncateIPToPrefix(ip4, v4PrefixLength)
+		return fmt.Sprintf("%s/%d", truncated.String(), v4PrefixLength)
+	}
+
+	truncated := truncateIPToPrefix(ip.To16(), v6PrefixLength)
+	return fmt.Sprintf("%s/%d", truncated.String(), v6PrefixLength)
+}
+
+// ecsSubnetForQuery returns the ECS subnet to forward upstream for request
+// from remoteAddr, or "" if none should be forwarded.
+func (processor *ednsProcessor) ecsSubnetForQuery(request *dns.Msg, remoteAddr net.Addr) string {
+	clientIP := clientIPFromRemoteAddr(remoteAddr)
+	if clientIP == nil {
+		return ""
+	}
+
+	policy, v4PrefixLength, v6PrefixLength := processor.policyForClient(clientIP)
+
+	switch policy {
+	case "forward":
+		sourceIP := clientIP
+		if opt := request.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					sourceIP = subnet.Address
+				}
+			}
+		}
+		return ecsSubnetString(sourceIP, v4PrefixLength, v6PrefixLength)
+
+	case "synthesize":
+		return ecsSubnetString(clientIP, v4PrefixLength, v6PrefixLength)
+
+	default:
+		return ""
+	}
+}
+
+// clientRequestedUDPSize returns the EDNS UDP payload size the client
+// advertised in request, or the plain DNS default if EDNS was not present.
+func clientRequestedUDPSize(request *dns.Msg) uint16 {
+	if opt := request.IsEdns0(); opt != nil {
+		return opt.UDPSize()
+	}
+
+	return dns.MinMsgSize
+}
+
+// negotiateUDPSize clamps the client's advertised EDNS UDP size against the
+// configured maximum.
+func (processor *ednsProcessor) negotiateUDPSize(request *dns.Msg) uint16 {
+	udpSize := clientRequestedUDPSize(request)
+	if udpSize > processor.maxUDPSize {
+		udpSize = processor.maxUDPSize
+	}
+	if udpSize < dns.MinMsgSize {
+		udpSize = dns.MinMsgSize
+	}
+
+	return udpSize
+}
+
+// truncateForUDP drops answer records from response until it fits within
+// udpSize, setting the truncated flag so the client retries over TCP.
+func truncateForUDP(response *dns.Msg, udpSize uint16) {
+	for (len(response.Answer) > 0) && (response.Len() > int(udpSize)) {
+		response.Answer = response.Answer[:len(response.Answer)-1]
+		response.Truncated = true
+	}
+}
+
+// ednsOptionCodeEDE is the IANA EDNS(0) option code for Extended DNS Errors
+// (RFC 8914). The github.com/miekg/dns version required in go.mod predates RFC 8914 support,
+// so the option arrives as a generic *dns.EDNS0_LOCAL; decode it by hand.
+const ednsOptionCodeEDE = 15
+
+// logUpstreamEDE logs any extended DNS error option carried in response's OPT record.
+func logUpstreamEDE(response *dns.Msg) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	for _, option := range opt.Option {
+		local, ok := option.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != ednsOptionCodeEDE || len(local.Data) < 2 {
+			continue
+		}
+
+		infoCode := uint16(local.Data[0])<<8 | uint16(local.Data[1])
+		extraText := string(local.Data[2:])
+		log.Printf("upstream extended DNS error: code = %v text = %q", infoCode, extraText)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// IPBlockPluginConfiguration configures the IP block plugin.
+type IPBlockPluginConfiguration struct {
+	Enabled          bool   `json:"enabled"`
+	BlockedCIDRsFile string `json:"blockedCIDRsFile"`
+}
+
+// ipBlockPlugin scans A/AAAA answers and rewrites the response to NXDOMAIN
+// when any answer address falls inside a configured blocked CIDR.
+type ipBlockPlugin struct {
+	metrics *metrics
+	cidrs   []*net.IPNet
+}
+
+func newIPBlockPlugin(configuration IPBlockPluginConfiguration, metrics *metrics) *ipBlockPlugin {
+	log.Printf("reading BlockedCIDRsFile %q", configuration.BlockedCIDRsFile)
+
+	file, err := os.Open(configuration.BlockedCIDRsFile)
+	if err != nil {
+		log.Fatalf("error opening BlockedCIDRsFile: %v", err)
+	}
+	defer file.Close()
+
+	var cidrs []*net.IPNet
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if (len(line) == 0) || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			log.Fatalf("error parsing BlockedCIDRsFile line %q: %v", line, err)
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("BlockedCIDRsFile scanner error: %v", err)
+	}
+
+	log.Printf("newIPBlockPlugin loaded %v cidrs", len(cidrs))
+
+	return &ipBlockPlugin{
+		metrics: metrics,
+		cidrs:   cidrs,
+	}
+}
+
+func (plugin *ipBlockPlugin) name() string {
+	return "ipBlock"
+}
+
+func (plugin *ipBlockPlugin) blocked(ip net.IP) bool {
+	for _, cidr := range plugin.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *ipBlockPlugin) onResponse(ctx context.Context, request, response *dns.Msg) *dns.Msg {
+	for _, rr := range response.Answer {
+		var ip net.IP
+
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+
+		if plugin.blocked(ip) {
+			plugin.metrics.incrementPluginBlocked(plugin.name())
+
+			blockedResponse := new(dns.Msg)
+			blockedResponse.SetRcode(request, dns.RcodeNameError)
+			return blockedResponse
+		}
+	}
+
+	return response
+}
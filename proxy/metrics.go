@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type metricValue struct {
+	count uint64
+}
+
+func (metricValue *metricValue) incrementCount() {
+	atomic.AddUint64(&metricValue.count, 1)
+}
+
+func (metricValue *metricValue) loadCount() uint64 {
+	return atomic.LoadUint64(&metricValue.count)
+}
+
+type pluginMetrics struct {
+	blockedValue     metricValue
+	synthesizedValue metricValue
+}
+
+type upstreamMetrics struct {
+	requestsValue metricValue
+	errorsValue   metricValue
+}
+
+type metrics struct {
+	cacheHitsValue           metricValue
+	cacheMissesValue         metricValue
+	clientErrorsValue        metricValue
+	writeResponseErrorsValue metricValue
+	dns64SynthesizedValue    metricValue
+	pluginMetricsMap         sync.Map
+	upstreamMetricsMap       sync.Map
+	prefetchAttemptsValue    metricValue
+	prefetchSuccessesValue   metricValue
+	prefetchErrorsValue      metricValue
+}
+
+func (metrics *metrics) incrementPrefetchAttempts() {
+	metrics.prefetchAttemptsValue.incrementCount()
+}
+
+func (metrics *metrics) prefetchAttempts() uint64 {
+	return metrics.prefetchAttemptsValue.loadCount()
+}
+
+func (metrics *metrics) incrementPrefetchSuccesses() {
+	metrics.prefetchSuccessesValue.incrementCount()
+}
+
+func (metrics *metrics) prefetchSuccesses() uint64 {
+	return metrics.prefetchSuccessesValue.loadCount()
+}
+
+func (metrics *metrics) incrementPrefetchErrors() {
+	metrics.prefetchErrorsValue.incrementCount()
+}
+
+func (metrics *metrics) prefetchErrors() uint64 {
+	return metrics.prefetchErrorsValue.loadCount()
+}
+
+func (metrics *metrics) upstreamMetricsFor(upstreamName string) *upstreamMetrics {
+	value, loaded := metrics.upstreamMetricsMap.Load(upstreamName)
+	if !loaded {
+		value, _ = metrics.upstreamMetricsMap.LoadOrStore(upstreamName, &upstreamMetrics{})
+	}
+	return value.(*upstreamMetrics)
+}
+
+func (metrics *metrics) incrementUpstreamRequests(upstreamName string) {
+	metrics.upstreamMetricsFor(upstreamName).requestsValue.incrementCount()
+}
+
+func (metrics *metrics) incrementUpstreamErrors(upstreamName string) {
+	metrics.upstreamMetricsFor(upstreamName).errorsValue.incrementCount()
+}
+
+func (metrics *metrics) upstreamMetricsSnapshot() map[string]string {
+	snapshot := make(map[string]string)
+
+	metrics.upstreamMetricsMap.Range(func(key, value interface{}) bool {
+		upstreamName := key.(string)
+		upstreamMetrics := value.(*upstreamMetrics)
+		snapshot[upstreamName] = fmt.Sprintf("requests = %v errors = %v",
+			upstreamMetrics.requestsValue.loadCount(), upstreamMetrics.errorsValue.loadCount())
+		return true
+	})
+
+	return snapshot
+}
+
+func (metrics *metrics) incrementDNS64Synthesized() {
+	metrics.dns64SynthesizedValue.incrementCount()
+}
+
+func (metrics *metrics) dns64Synthesized() uint64 {
+	return metrics.dns64SynthesizedValue.loadCount()
+}
+
+func (metrics *metrics) pluginMetricsFor(pluginName string) *pluginMetrics {
+	value, loaded := metrics.pluginMetricsMap.Load(pluginName)
+	if !loaded {
+		value, _ = metrics.pluginMetricsMap.LoadOrStore(pluginName, &pluginMetrics{})
+	}
+	return value.(*pluginMetrics)
+}
+
+func (metrics *metrics) incrementPluginBlocked(pluginName string) {
+	metrics.pluginMetricsFor(pluginName).blockedValue.incrementCount()
+}
+
+func (metrics *metrics) incrementPluginSynthesized(pluginName string) {
+	metrics.pluginMetricsFor(pluginName).synthesizedValue.incrementCount()
+}
+
+func (metrics *metrics) pluginMetricsSnapshot() map[string]string {
+	snapshot := make(map[string]string)
+
+	metrics.pluginMetricsMap.Range(func(key, value interface{}) bool {
+		pluginName := key.(string)
+		pluginMetrics := value.(*pluginMetrics)
+		snapshot[pluginName] = fmt.Sprintf("blocked = %v synthesized = %v",
+			pluginMetrics.blockedValue.loadCount(), pluginMetrics.synthesizedValue.loadCount())
+		return true
+	})
+
+	return snapshot
+}
+
+func (metrics *metrics) incrementCacheHits() {
+	metrics.cacheHitsValue.incrementCount()
+}
+
+func (metrics *metrics) cacheHits() uint64 {
+	return metrics.cacheHitsValue.loadCount()
+}
+
+func (metrics *metrics) incrementCacheMisses() {
+	metrics.cacheMissesValue.incrementCount()
+}
+
+func (metrics *metrics) cacheMisses() uint64 {
+	return metrics.cacheMissesValue.loadCount()
+}
+
+func (metrics *metrics) incrementClientErrors() {
+	metrics.clientErrorsValue.incrementCount()
+}
+
+func (metrics *metrics) clientErrors() uint64 {
+	return metrics.clientErrorsValue.loadCount()
+}
+
+func (metrics *metrics) incrementWriteResponseErrors() {
+	metrics.writeResponseErrorsValue.incrementCount()
+}
+
+func (metrics *metrics) writeResponseErrors() uint64 {
+	return metrics.writeResponseErrorsValue.loadCount()
+}
+
+func (metrics *metrics) String() string {
+	return fmt.Sprintf(
+		"cacheHits = %v cacheMisses = %v clientErrors = %v writeResponseErrors = %v dns64Synthesized = %v "+
+			"pluginMetrics = %v upstreamMetrics = %v prefetchAttempts = %v prefetchSuccesses = %v prefetchErrors = %v",
+		metrics.cacheHits(), metrics.cacheMisses(), metrics.clientErrors(), metrics.writeResponseErrors(),
+		metrics.dns64Synthesized(), metrics.pluginMetricsSnapshot(), metrics.upstreamMetricsSnapshot(),
+		metrics.prefetchAttempts(), metrics.prefetchSuccesses(), metrics.prefetchErrors())
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NameBlockPluginConfiguration configures the name allow/block plugin.
+type NameBlockPluginConfiguration struct {
+	Enabled          bool   `json:"enabled"`
+	BlockedNamesFile string `json:"blockedNamesFile"`
+}
+
+type nameMatchType int
+
+const (
+	nameMatchExact nameMatchType = iota
+	nameMatchSuffix
+	nameMatchPrefix
+	nameMatchSubstring
+	nameMatchRegex
+)
+
+// nameMatcher matches a qname using one of the supported match types. Lines
+// in the BlockedNamesFile look like "<matchType>:<pattern>", e.g.
+// "suffix:.doubleclick.net." or "regex:^ads[0-9]+\.example\.com\.$".
+// A line with no recognized "<matchType>:" prefix is treated as exact.
+type nameMatcher struct {
+	matchType nameMatchType
+	pattern   string
+	regex     *regexp.Regexp
+}
+
+func (matcher *nameMatcher) matches(name string) bool {
+	switch matcher.matchType {
+	case nameMatchExact:
+		return name == matcher.pattern
+	case nameMatchSuffix:
+		return strings.HasSuffix(name, matcher.pattern)
+	case nameMatchPrefix:
+		return strings.HasPrefix(name, matcher.pattern)
+	case nameMatchSubstring:
+		return strings.Contains(name, matcher.pattern)
+	case nameMatchRegex:
+		return matcher.regex.MatchString(name)
+	default:
+		return false
+	}
+}
+
+// nameMatcherAction is the action associated with a nameMatcher: block the
+// query, or allow it through even if a block matcher also matches.
+type nameMatcherAction int
+
+const (
+	nameMatcherActionBlock nameMatcherAction = iota
+	nameMatcherActionAllow
+)
+
+func parseNameMatcher(line string) (*nameMatcher, nameMatcherAction, error) {
+	action := nameMatcherActionBlock
+	if rest := strings.TrimPrefix(line, "allow:"); rest != line {
+		action = nameMatcherActionAllow
+		line = rest
+	}
+
+	matchTypeString := "exact"
+	pattern := line
+
+	if idx := strings.Index(line, ":"); idx >= 0 {
+		switch line[:idx] {
+		case "exact", "suffix", "prefix", "substring", "regex":
+			matchTypeString = line[:idx]
+			pattern = line[idx+1:]
+		}
+	}
+
+	matcher := &nameMatcher{
+		pattern: strings.ToLower(pattern),
+	}
+
+	switch matchTypeString {
+	case "exact":
+		matcher.matchType = nameMatchExact
+	case "suffix":
+		matcher.matchType = nameMatchSuffix
+	case "prefix":
+		matcher.matchType = nameMatchPrefix
+	case "substring":
+		matcher.matchType = nameMatchSubstring
+	case "regex":
+		matcher.matchType = nameMatchRegex
+		regex, err := regexp.Compile(matcher.pattern)
+		if err != nil {
+			return nil, action, fmt.Errorf("regexp.Compile error: %w", err)
+		}
+		matcher.regex = regex
+	}
+
+	return matcher, action, nil
+}
+
+// nameBlockPlugin rejects queries for names matching any configured blocked
+// name pattern, answering with NXDOMAIN instead of reaching the upstream
+// resolver. A line prefixed "allow:" (e.g. "allow:suffix:.good.ads.net.")
+// carves out an exception: it always takes precedence over block matchers,
+// regardless of file order.
+type nameBlockPlugin struct {
+	metrics       *metrics
+	blockMatchers []*nameMatcher
+	allowMatchers []*nameMatcher
+}
+
+func newNameBlockPlugin(configuration NameBlockPluginConfiguration, metrics *metrics) *nameBlockPlugin {
+	log.Printf("reading BlockedNamesFile %q", configuration.BlockedNamesFile)
+
+	file, err := os.Open(configuration.BlockedNamesFile)
+	if err != nil {
+		log.Fatalf("error opening BlockedNamesFile: %v", err)
+	}
+	defer file.Close()
+
+	var blockMatchers []*nameMatcher
+	var allowMatchers []*nameMatcher
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if (len(line) == 0) || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		matcher, action, err := parseNameMatcher(line)
+		if err != nil {
+			log.Fatalf("error parsing BlockedNamesFile line %q: %v", line, err)
+		}
+
+		if action == nameMatcherActionAllow {
+			allowMatchers = append(allowMatchers, matcher)
+		} else {
+			blockMatchers = append(blockMatchers, matcher)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("BlockedNamesFile scanner error: %v", err)
+	}
+
+	log.Printf("newNameBlockPlugin loaded %v block matchers %v allow matchers", len(blockMatchers), len(allowMatchers))
+
+	return &nameBlockPlugin{
+		metrics:       metrics,
+		blockMatchers: blockMatchers,
+		allowMatchers: allowMatchers,
+	}
+}
+
+func (plugin *nameBlockPlugin) name() string {
+	return "nameBlock"
+}
+
+func (plugin *nameBlockPlugin) onQuery(ctx context.Context, request *dns.Msg) (pluginAction, *dns.Msg, int) {
+	if len(request.Question) == 0 {
+		return actionContinue, nil, 0
+	}
+
+	name := strings.ToLower(request.Question[0].Name)
+
+	for _, matcher := range plugin.allowMatchers {
+		if matcher.matches(name) {
+			return actionContinue, nil, 0
+		}
+	}
+
+	for _, matcher := range plugin.blockMatchers {
+		if matcher.matches(name) {
+			plugin.metrics.incrementPluginBlocked(plugin.name())
+			return actionReject, nil, dns.RcodeNameError
+		}
+	}
+
+	return actionContinue, nil, 0
+}
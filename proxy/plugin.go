@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// pluginAction describes what a query plugin wants the proxy to do next.
+type pluginAction int
+
+const (
+	// actionContinue lets the query proceed through the remaining plugins and upstream resolution.
+	actionContinue pluginAction = iota
+	// actionSynthesize means the plugin produced a final response to return to the client.
+	actionSynthesize
+	// actionDrop means the query should be silently dropped, with no response written.
+	actionDrop
+	// actionReject means the query should be answered with the given rcode (e.g. dns.RcodeRefused or dns.RcodeNameError).
+	actionReject
+)
+
+// queryPlugin inspects (and may short-circuit) an incoming query before it reaches the cache or upstream resolver.
+type queryPlugin interface {
+	name() string
+	onQuery(ctx context.Context, request *dns.Msg) (pluginAction, *dns.Msg, int)
+}
+
+// responsePlugin inspects (and may rewrite) a response before it is cached and written to the client.
+type responsePlugin interface {
+	name() string
+	onResponse(ctx context.Context, request, response *dns.Msg) *dns.Msg
+}
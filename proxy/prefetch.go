@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// dns64CacheKeySuffix marks cache entries holding DNS64-synthesized AAAA
+// answers (see dns64CacheKey in dns64.go). Prefetch must not refresh these
+// through a raw upstream query: that would bypass maybeSynthesizeAAAA and
+// overwrite the synthesized record with the real (typically NODATA) AAAA
+// answer, silently breaking DNS64 synthesis for the name until it expires.
+const dns64CacheKeySuffix = ":dns64"
+
+// PrefetchConfiguration configures proactive refresh of hot cache entries
+// nearing expiry.
+type PrefetchConfiguration struct {
+	Enabled              bool    `json:"enabled"`
+	MinHitCount          uint64  `json:"minHitCount"`
+	TTLRemainingFraction float64 `json:"ttlRemainingFraction"`
+	IntervalSeconds      int     `json:"intervalSeconds"`
+}
+
+// prefetcher periodically scans the cache for hot entries nearing expiry and
+// proactively re-resolves them so live queries never observe a cold miss.
+type prefetcher struct {
+	configuration PrefetchConfiguration
+	dnsProxy      *dnsProxy
+	group         singleflight.Group
+}
+
+func newPrefetcher(configuration PrefetchConfiguration, dnsProxy *dnsProxy) *prefetcher {
+	return &prefetcher{
+		configuration: configuration,
+		dnsProxy:      dnsProxy,
+	}
+}
+
+func (prefetcher *prefetcher) refreshEntry(cacheKey string, cacheObject *cacheObject) {
+	if !cacheObject.tryBeginRefresh() {
+		return
+	}
+	defer cacheObject.endRefresh()
+
+	if len(cacheObject.message.Question) != 1 {
+		return
+	}
+
+	question := cacheObject.message.Question[0]
+	request := new(dns.Msg)
+	request.SetQuestion(question.Name, question.Qtype)
+
+	prefetcher.dnsProxy.metrics.incrementPrefetchAttempts()
+
+	_, err, _ := prefetcher.group.Do(cacheKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		responseMsg, _, err := prefetcher.dnsProxy.dohClient.makeHTTPRequest(ctx, request, "")
+		if err != nil {
+			return nil, err
+		}
+
+		responseMsg = prefetcher.dnsProxy.runResponsePlugins(ctx, request, responseMsg)
+
+		prefetcher.dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg)
+
+		return nil, nil
+	})
+
+	if err != nil {
+		prefetcher.dnsProxy.metrics.incrementPrefetchErrors()
+		log.Printf("prefetch refresh error for %q: %v", cacheKey, err)
+		return
+	}
+
+	prefetcher.dnsProxy.metrics.incrementPrefetchSuccesses()
+}
+
+func (prefetcher *prefetcher) runOnce() {
+	now := time.Now()
+	cache := &prefetcher.dnsProxy.cache
+
+	for _, cacheKey := range cache.keys() {
+		if strings.HasSuffix(cacheKey, dns64CacheKeySuffix) {
+			continue
+		}
+
+		cacheObject, ok := cache.peek(cacheKey)
+		if !ok {
+			continue
+		}
+
+		if cacheObject.expired(now) {
+			continue
+		}
+
+		if cacheObject.loadHitCount() < prefetcher.configuration.MinHitCount {
+			continue
+		}
+
+		if cacheObject.ttlFractionRemaining(now) > prefetcher.configuration.TTLRemainingFraction {
+			continue
+		}
+
+		prefetcher.refreshEntry(cacheKey, cacheObject)
+	}
+}
+
+func (prefetcher *prefetcher) run() {
+	interval := time.Duration(prefetcher.configuration.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		prefetcher.runOnce()
+	}
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogConfiguration configures the structured per-transaction query log.
+type QueryLogConfiguration struct {
+	Enabled            bool     `json:"enabled"`
+	Format             string   `json:"format"` // ltsv, jsonl, ndjson
+	File               string   `json:"file"`
+	MaxSizeBytes       int64    `json:"maxSizeBytes"`
+	MaxAgeSeconds      int64    `json:"maxAgeSeconds"`
+	IncludeQtypes      []string `json:"includeQtypes"`
+	IncludeClientCIDRs []string `json:"includeClientCIDRs"`
+	SampleRate         float64  `json:"sampleRate"`
+}
+
+// queryLogRecord is one structured record describing a single DNS transaction.
+type queryLogRecord struct {
+	Timestamp     time.Time
+	ClientAddress string
+	QName         string
+	QType         string
+	QClass        string
+	Rcode         string
+	AnswerCount   int
+	CacheStatus   string
+	Upstream      string
+	LatencyMs     int64
+	PluginAction  string
+}
+
+// queryLog writes structured queryLogRecords to a rotating file.
+type queryLog struct {
+	configuration      QueryLogConfiguration
+	includeQtypes      map[string]bool
+	includeClientCIDRs []*net.IPNet
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newQueryLog(configuration QueryLogConfiguration) *queryLog {
+	includeQtypes := make(map[string]bool)
+	for _, qtype := range configuration.IncludeQtypes {
+		includeQtypes[strings.ToUpper(qtype)] = true
+	}
+
+	var includeClientCIDRs []*net.IPNet
+	for _, cidrString := range configuration.IncludeClientCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidrString)
+		if err != nil {
+			log.Fatalf("error parsing queryLog includeClientCIDRs entry %q: %v", cidrString, err)
+		}
+		includeClientCIDRs = append(includeClientCIDRs, ipNet)
+	}
+
+	queryLog := &queryLog{
+		configuration:      configuration,
+		includeQtypes:      includeQtypes,
+		includeClientCIDRs: includeClientCIDRs,
+	}
+
+	if err := queryLog.openFile(); err != nil {
+		log.Fatalf("error opening queryLog file %q: %v", configuration.File, err)
+	}
+
+	return queryLog
+}
+
+func (queryLog *queryLog) openFile() error {
+	file, err := os.OpenFile(queryLog.configuration.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile error: %w", err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("file.Stat error: %w", err)
+	}
+
+	queryLog.file = file
+	queryLog.size = fileInfo.Size()
+	queryLog.openedAt = time.Now()
+
+	return nil
+}
+
+func (queryLog *queryLog) rotate() {
+	if queryLog.file != nil {
+		queryLog.file.Close()
+	}
+
+	rotatedName := fmt.Sprintf("%v.%v", queryLog.configuration.File, time.Now().Unix())
+	if err := os.Rename(queryLog.configuration.File, rotatedName); err != nil {
+		log.Printf("queryLog rotate error renaming %q: %v", queryLog.configuration.File, err)
+	}
+
+	if err := queryLog.openFile(); err != nil {
+		log.Fatalf("error reopening queryLog file %q after rotation: %v", queryLog.configuration.File, err)
+	}
+}
+
+func (queryLog *queryLog) needsRotation() bool {
+	if (queryLog.configuration.MaxSizeBytes > 0) && (queryLog.size >= queryLog.configuration.MaxSizeBytes) {
+		return true
+	}
+
+	if queryLog.configuration.MaxAgeSeconds > 0 {
+		maxAge := time.Second * time.Duration(queryLog.configuration.MaxAgeSeconds)
+		if time.Since(queryLog.openedAt) >= maxAge {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (queryLog *queryLog) clientAllowed(clientAddress string) bool {
+	if len(queryLog.includeClientCIDRs) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(clientAddress)
+	if err != nil {
+		host = clientAddress
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range queryLog.includeClientCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (queryLog *queryLog) qtypeAllowed(qtype string) bool {
+	if len(queryLog.includeQtypes) == 0 {
+		return true
+	}
+
+	return queryLog.includeQtypes[strings.ToUpper(qtype)]
+}
+
+func (queryLog *queryLog) sampled() bool {
+	if queryLog.configuration.SampleRate <= 0 {
+		return false
+	}
+
+	if queryLog.configuration.SampleRate >= 1 {
+		return true
+	}
+
+	return rand.Float64() < queryLog.configuration.SampleRate
+}
+
+func formatLTSV(record queryLogRecord) string {
+	return fmt.Sprintf(
+		"time:%v\tclient:%v\tqname:%v\tqtype:%v\tqclass:%v\trcode:%v\tanswers:%v\tcache:%v\tupstream:%v\tlatencyMs:%v\tpluginAction:%v\n",
+		record.Timestamp.Format(time.RFC3339), record.ClientAddress, record.QName, record.QType, record.QClass,
+		record.Rcode, record.AnswerCount, record.CacheStatus, record.Upstream, record.LatencyMs, record.PluginAction)
+}
+
+func formatJSONL(record queryLogRecord) (string, error) {
+	type jsonRecord struct {
+		Timestamp     string `json:"timestamp"`
+		ClientAddress string `json:"clientAddress"`
+		QName         string `json:"qname"`
+		QType         string `json:"qtype"`
+		QClass        string `json:"qclass"`
+		Rcode         string `json:"rcode"`
+		AnswerCount   int    `json:"answerCount"`
+		CacheStatus   string `json:"cacheStatus"`
+		Upstream      string `json:"upstream"`
+		LatencyMs     int64  `json:"latencyMs"`
+		PluginAction  string `json:"pluginAction"`
+	}
+
+	line, err := json.Marshal(jsonRecord{
+		Timestamp:     record.Timestamp.Format(time.RFC3339),
+		ClientAddress: record.ClientAddress,
+		QName:         record.QName,
+		QType:         record.QType,
+		QClass:        record.QClass,
+		Rcode:         record.Rcode,
+		AnswerCount:   record.AnswerCount,
+		CacheStatus:   record.CacheStatus,
+		Upstream:      record.Upstream,
+		LatencyMs:     record.LatencyMs,
+		PluginAction:  record.PluginAction,
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal error: %w", err)
+	}
+
+	return string(line) + "\n", nil
+}
+
+func (queryLog *queryLog) formatRecord(record queryLogRecord) (string, error) {
+	switch queryLog.configuration.Format {
+	case "ltsv":
+		return formatLTSV(record), nil
+	case "jsonl", "ndjson":
+		return formatJSONL(record)
+	default:
+		return formatJSONL(record)
+	}
+}
+
+// write filters, samples, formats, and appends record to the query log file.
+func (queryLog *queryLog) write(record queryLogRecord) {
+	if !queryLog.qtypeAllowed(record.QType) {
+		return
+	}
+
+	if !queryLog.clientAllowed(record.ClientAddress) {
+		return
+	}
+
+	if !queryLog.sampled() {
+		return
+	}
+
+	line, err := queryLog.formatRecord(record)
+	if err != nil {
+		log.Printf("queryLog formatRecord error: %v", err)
+		return
+	}
+
+	queryLog.mutex.Lock()
+	defer queryLog.mutex.Unlock()
+
+	if queryLog.needsRotation() {
+		queryLog.rotate()
+	}
+
+	n, err := queryLog.file.WriteString(line)
+	if err != nil {
+		log.Printf("queryLog write error: %v", err)
+		return
+	}
+
+	queryLog.size += int64(n)
+}
+
+// logQuery is the single hook all response paths call to record a query log entry.
+func (dnsProxy *dnsProxy) logQuery(record queryLogRecord) {
+	if dnsProxy.queryLog == nil {
+		return
+	}
+
+	record.Timestamp = time.Now()
+	dnsProxy.queryLog.write(record)
+}
+
+func rcodeString(response *dns.Msg) string {
+	if response == nil {
+		return ""
+	}
+
+	return dns.RcodeToString[response.Rcode]
+}
+
+func answerCount(response *dns.Msg) int {
+	if response == nil {
+		return 0
+	}
+
+	return len(response.Answer)
+}
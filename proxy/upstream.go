@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamHealthCheckConfiguration configures the periodic background probe
+// used to take an unhealthy upstream out of rotation and bring it back once
+// it starts answering again.
+type UpstreamHealthCheckConfiguration struct {
+	Enabled          bool   `json:"enabled"`
+	CanaryName       string `json:"canaryName"`
+	IntervalSeconds  int    `json:"intervalSeconds"`
+	FailureThreshold int    `json:"failureThreshold"`
+	SuccessThreshold int    `json:"successThreshold"`
+}
+
+// UpstreamManagerConfiguration configures the set of upstream DoH resolvers
+// and the selection strategy: "fastest", "parallel", "failover", or
+// "roundRobin" (the default).
+type UpstreamManagerConfiguration struct {
+	Strategy         string                           `json:"strategy"`
+	FastestRaceCount int                              `json:"fastestRaceCount"`
+	HealthCheck      UpstreamHealthCheckConfiguration `json:"healthCheck"`
+}
+
+// upstreamState tracks health and latency for one upstream DoH resolver.
+type upstreamState struct {
+	urlObject            url.URL
+	latencyEWMAMs        uint64
+	consecutiveErrors    uint64
+	consecutiveSuccesses uint64
+	healthy              int32
+}
+
+func newUpstreamState(rawURL string) *upstreamState {
+	urlObject, err := url.Parse(rawURL)
+	if err != nil {
+		log.Fatalf("error parsing upstream url %q: %v", rawURL, err)
+	}
+
+	return &upstreamState{
+		urlObject: *urlObject,
+		healthy:   1,
+	}
+}
+
+func (upstream *upstreamState) isHealthy() bool {
+	return atomic.LoadInt32(&upstream.healthy) != 0
+}
+
+func (upstream *upstreamState) setHealthy(healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+	atomic.StoreInt32(&upstream.healthy, value)
+}
+
+func (upstream *upstreamState) recordLatency(d time.Duration) {
+	const ewmaWeight = 0.2
+	newSampleMs := uint64(d.Milliseconds())
+
+	for {
+		oldValue := atomic.LoadUint64(&upstream.latencyEWMAMs)
+
+		updatedValue := newSampleMs
+		if oldValue != 0 {
+			updatedValue = uint64((float64(oldValue) * (1 - ewmaWeight)) + (float64(newSampleMs) * ewmaWeight))
+		}
+
+		if atomic.CompareAndSwapUint64(&upstream.latencyEWMAMs, oldValue, updatedValue) {
+			break
+		}
+	}
+}
+
+func (upstream *upstreamState) latencyEWMA() time.Duration {
+	return time.Duration(atomic.LoadUint64(&upstream.latencyEWMAMs)) * time.Millisecond
+}
+
+func (upstream *upstreamState) recordSuccess(healthCheckConfiguration UpstreamHealthCheckConfiguration) {
+	atomic.StoreUint64(&upstream.consecutiveErrors, 0)
+
+	successes := atomic.AddUint64(&upstream.consecutiveSuccesses, 1)
+	if (!upstream.isHealthy()) && (int(successes) >= healthCheckConfiguration.SuccessThreshold) {
+		upstream.setHealthy(true)
+		log.Printf("upstream %v recovered, returning to rotation", upstream.urlObject.String())
+	}
+}
+
+func (upstream *upstreamState) recordError(healthCheckConfiguration UpstreamHealthCheckConfiguration) {
+	atomic.StoreUint64(&upstream.consecutiveSuccesses, 0)
+
+	errors := atomic.AddUint64(&upstream.consecutiveErrors, 1)
+	if upstream.isHealthy() && (int(errors) >= healthCheckConfiguration.FailureThreshold) {
+		upstream.setHealthy(false)
+		log.Printf("upstream %v unhealthy, removing from rotation", upstream.urlObject.String())
+	}
+}
+
+func buildUpstreamRequestURL(urlObject url.URL, question *dns.Question, ecsSubnet string) string {
+	queryParameters := url.Values{}
+	queryParameters.Set("name", question.Name)
+	queryParameters.Set("type", dns.Type(question.Qtype).String())
+
+	if len(ecsSubnet) > 0 {
+		queryParameters.Set("edns_client_subnet", ecsSubnet)
+	}
+
+	urlObject.RawQuery = queryParameters.Encode()
+
+	return urlObject.String()
+}
+
+// performUpstreamRequest sends a single DoH JSON API request to upstream and
+// updates its latency, health, and metrics bookkeeping.
+func performUpstreamRequest(ctx context.Context, upstream *upstreamState, healthCheckConfiguration UpstreamHealthCheckConfiguration, metrics *metrics, r *dns.Msg, question *dns.Question, ecsSubnet string) (*dns.Msg, error) {
+	upstreamName := upstream.urlObject.String()
+	metrics.incrementUpstreamRequests(upstreamName)
+
+	urlString := buildUpstreamRequestURL(upstream.urlObject, question, ecsSubnet)
+
+	startTime := time.Now()
+
+	responseMsg, err := func() (*dns.Msg, error) {
+		httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, urlString, nil)
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequestWithContext error: %w", err)
+		}
+
+		httpRequest.Header.Set("Accept", dnsJSONMIMEType)
+
+		httpResponse, err := http.DefaultClient.Do(httpRequest)
+		if err != nil {
+			return nil, fmt.Errorf("http.DefaultClient.Do error: %w", err)
+		}
+		defer httpResponse.Body.Close()
+
+		if httpResponse.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("non 200 http response code %v", httpResponse.StatusCode)
+		}
+
+		responseBuffer, err := ioutil.ReadAll(httpResponse.Body)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadAll error: %w", err)
+		}
+
+		return decodeJSONResponse(r, responseBuffer)
+	}()
+
+	if err != nil {
+		upstream.recordError(healthCheckConfiguration)
+		metrics.incrementUpstreamErrors(upstreamName)
+		return nil, err
+	}
+
+	upstream.recordLatency(time.Since(startTime))
+	upstream.recordSuccess(healthCheckConfiguration)
+
+	return responseMsg, nil
+}
+
+// upstreamManager selects among one or more upstream DoH resolvers according
+// to the configured strategy, tracking per-upstream health and latency.
+type upstreamManager struct {
+	configuration UpstreamManagerConfiguration
+	upstreams     []*upstreamState
+	metrics       *metrics
+	nextIndex     uint64
+}
+
+func newUpstreamManager(remoteHTTPURLs []string, configuration UpstreamManagerConfiguration, metrics *metrics) *upstreamManager {
+	var upstreams []*upstreamState
+	for _, rawURL := range remoteHTTPURLs {
+		upstreams = append(upstreams, newUpstreamState(rawURL))
+	}
+
+	manager := &upstreamManager{
+		configuration: configuration,
+		upstreams:     upstreams,
+		metrics:       metrics,
+	}
+
+	if configuration.HealthCheck.Enabled {
+		go manager.runHealthChecks()
+	}
+
+	return manager
+}
+
+func (manager *upstreamManager) healthyUpstreams() []*upstreamState {
+	var healthy []*upstreamState
+	for _, upstream := range manager.upstreams {
+		if upstream.isHealthy() {
+			healthy = append(healthy, upstream)
+		}
+	}
+
+	if len(healthy) == 0 {
+		// every upstream is marked unhealthy: degrade gracefully rather than fail closed
+		return manager.upstreams
+	}
+
+	return healthy
+}
+
+func (manager *upstreamManager) makeRoundRobinRequest(ctx context.Context, r *dns.Msg, question *dns.Question, ecsSubnet string) (*dns.Msg, string, error) {
+	candidates := manager.healthyUpstreams()
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("no upstreams configured")
+	}
+
+	index := atomic.AddUint64(&manager.nextIndex, 1)
+	upstream := candidates[index%uint64(len(candidates))]
+
+	log.Printf("upstreamManager roundRobin selected %v", upstream.urlObject.String())
+
+	responseMsg, err := performUpstreamRequest(ctx, upstream, manager.configuration.HealthCheck, manager.metrics, r, question, ecsSubnet)
+	return responseMsg, upstream.urlObject.String(), err
+}
+
+func (manager *upstreamManager) makeFailoverRequest(ctx context.Context, r *dns.Msg, question *dns.Question, ecsSubnet string) (responseMsg *dns.Msg, upstreamName string, err error) {
+	for _, upstream := range manager.upstreams {
+		if !upstream.isHealthy() {
+			continue
+		}
+
+		log.Printf("upstreamManager failover trying %v", upstream.urlObject.String())
+
+		responseMsg, err = performUpstreamRequest(ctx, upstream, manager.configuration.HealthCheck, manager.metrics, r, question, ecsSubnet)
+		if err == nil {
+			return responseMsg, upstream.urlObject.String(), nil
+		}
+	}
+
+	if err == nil {
+		err = fmt.Errorf("no healthy upstreams available")
+	}
+
+	return nil, "", err
+}
+
+type upstreamRaceResult struct {
+	upstream *upstreamState
+	response *dns.Msg
+	err      error
+}
+
+// raceUpstreams sends the request to every upstream in upstreams concurrently
+// and returns the first successful response, cancelling the rest.
+func (manager *upstreamManager) raceUpstreams(ctx context.Context, upstreams []*upstreamState, r *dns.Msg, question *dns.Question, ecsSubnet string) (*dns.Msg, string, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultChannel := make(chan upstreamRaceResult, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream *upstreamState) {
+			responseMsg, err := performUpstreamRequest(raceCtx, upstream, manager.configuration.HealthCheck, manager.metrics, r, question, ecsSubnet)
+			resultChannel <- upstreamRaceResult{upstream: upstream, response: responseMsg, err: err}
+		}(upstream)
+	}
+
+	var lastErr error
+	for i := 0; i < len(upstreams); i++ {
+		result := <-resultChannel
+		if result.err == nil {
+			log.Printf("upstreamManager race winner %v", result.upstream.urlObject.String())
+			return result.response, result.upstream.urlObject.String(), nil
+		}
+		lastErr = result.err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstreams available")
+	}
+
+	return nil, "", lastErr
+}
+
+func (manager *upstreamManager) makeFastestRequest(ctx context.Context, r *dns.Msg, question *dns.Question, ecsSubnet string) (*dns.Msg, string, error) {
+	candidates := manager.healthyUpstreams()
+
+	raceCount := manager.configuration.FastestRaceCount
+	if (raceCount <= 0) || (raceCount > len(candidates)) {
+		raceCount = len(candidates)
+	}
+
+	return manager.raceUpstreams(ctx, candidates[:raceCount], r, question, ecsSubnet)
+}
+
+func (manager *upstreamManager) makeParallelRequest(ctx context.Context, r *dns.Msg, question *dns.Question, ecsSubnet string) (*dns.Msg, string, error) {
+	return manager.raceUpstreams(ctx, manager.healthyUpstreams(), r, question, ecsSubnet)
+}
+
+func (manager *upstreamManager) makeHTTPRequest(ctx context.Context, r *dns.Msg, ecsSubnet string) (*dns.Msg, string, error) {
+	if len(r.Question) != 1 {
+		return nil, "", fmt.Errorf("invalid question length %v request %v", len(r.Question), r)
+	}
+
+	question := &r.Question[0]
+
+	switch manager.configuration.Strategy {
+	case "fastest":
+		return manager.makeFastestRequest(ctx, r, question, ecsSubnet)
+	case "parallel":
+		return manager.makeParallelRequest(ctx, r, question, ecsSubnet)
+	case "failover":
+		return manager.makeFailoverRequest(ctx, r, question, ecsSubnet)
+	default:
+		return manager.makeRoundRobinRequest(ctx, r, question, ecsSubnet)
+	}
+}
+
+func (manager *upstreamManager) runCanaryProbe(upstream *upstreamState) {
+	canaryRequest := new(dns.Msg)
+	canaryRequest.SetQuestion(dns.Fqdn(manager.configuration.HealthCheck.CanaryName), dns.TypeA)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := performUpstreamRequest(ctx, upstream, manager.configuration.HealthCheck, manager.metrics, canaryRequest, &canaryRequest.Question[0], ""); err != nil {
+		log.Printf("upstreamManager canary probe error for %v: %v", upstream.urlObject.String(), err)
+	}
+}
+
+func (manager *upstreamManager) runHealthChecks() {
+	interval := time.Duration(manager.configuration.HealthCheck.IntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for _, upstream := range manager.upstreams {
+			manager.runCanaryProbe(upstream)
+		}
+	}
+}